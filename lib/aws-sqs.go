@@ -0,0 +1,566 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+// defaultPeriod and defaultDelay mirror telegraf's cloudwatch input: CloudWatch
+// metrics typically land a few minutes after the fact, so the fetch window has
+// to trail "now" by at least that long or GetMetricData comes back empty.
+const (
+	defaultPeriod = 60
+	defaultDelay  = 300
+
+	// defaultQueueCacheTTL bounds how often -all-queues/-queue-name-pattern
+	// re-list queues via cloudwatch.ListMetrics, the same way telegraf's
+	// MetricCache avoids re-discovering dimensions on every collection.
+	defaultQueueCacheTTL = 1 * time.Hour
+)
+
+// cloudwatchClient is the subset of *cloudwatch.CloudWatch the plugin needs,
+// narrowed to an interface so tests can swap in a fake.
+type cloudwatchClient interface {
+	GetMetricStatistics(*cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error)
+	GetMetricData(*cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error)
+	ListMetrics(*cloudwatch.ListMetricsInput) (*cloudwatch.ListMetricsOutput, error)
+}
+
+// SQSPlugin mackerel plugin
+type SQSPlugin struct {
+	AccessKeyID          string
+	SecretAccessKey      string
+	Token                string
+	Profile              string
+	SharedCredentialFile string
+	RoleARN              string
+	RoleSessionName      string
+	ExternalID           string
+	EndpointURL          string
+	CloudWatch           cloudwatchClient
+	QueueName            string
+	QueueNamePattern     string
+	AllQueues            bool
+	RateLimit            float64
+	Prefix               string
+	Region               string
+	Period               int64
+	Delay                int64
+
+	queueCache *queueCache
+}
+
+// queueCache remembers the result of the last ListMetrics-based queue
+// discovery so FetchMetrics doesn't re-enumerate every queue in the account
+// on each collection cycle.
+type queueCache struct {
+	queues []string
+	built  time.Time
+	ttl    time.Duration
+}
+
+func (c *queueCache) valid() bool {
+	return c != nil && c.queues != nil && time.Since(c.built) < c.ttl
+}
+
+type metric struct {
+	Type         string
+	Name         string
+	Unit         string
+	MackerelName string
+	// Group is the graph-key segment this metric is graphed under (see
+	// GraphDefinition's "messages"/"message_size"/"queue" groups), needed to
+	// reconstruct a wildcard-matching stats key in fetchAllQueues.
+	Group string
+}
+
+func (m metric) name() string {
+	if m.MackerelName != "" {
+		return m.MackerelName
+	}
+	return m.Name
+}
+
+var sqsMetrics = []metric{
+	{
+		Name:  "NumberOfMessagesSent",
+		Type:  "Sum",
+		Unit:  "Count",
+		Group: "messages",
+	},
+	{
+		Name:  "NumberOfMessagesReceived",
+		Type:  "Sum",
+		Unit:  "Count",
+		Group: "messages",
+	},
+	{
+		Name:  "NumberOfEmptyReceives",
+		Type:  "Sum",
+		Unit:  "Count",
+		Group: "messages",
+	},
+	{
+		Name:  "NumberOfMessagesDeleted",
+		Type:  "Sum",
+		Unit:  "Count",
+		Group: "messages",
+	},
+	{
+		Name:         "SentMessageSize",
+		Type:         "Average",
+		Unit:         "Bytes",
+		MackerelName: "SentMessageSizeAverage",
+		Group:        "message_size",
+	},
+	{
+		Name:         "SentMessageSize",
+		Type:         "Maximum",
+		Unit:         "Bytes",
+		MackerelName: "SentMessageSizeMax",
+		Group:        "message_size",
+	},
+	{
+		Name:         "SentMessageSize",
+		Type:         "Minimum",
+		Unit:         "Bytes",
+		MackerelName: "SentMessageSizeMin",
+		Group:        "message_size",
+	},
+	{
+		Name:  "ApproximateNumberOfMessagesDelayed",
+		Type:  "Average",
+		Unit:  "Count",
+		Group: "queue",
+	},
+	{
+		Name:  "ApproximateNumberOfMessagesVisible",
+		Type:  "Average",
+		Unit:  "Count",
+		Group: "queue",
+	},
+	{
+		Name:  "ApproximateNumberOfMessagesNotVisible",
+		Type:  "Average",
+		Unit:  "Count",
+		Group: "queue",
+	},
+	{
+		Name:  "ApproximateAgeOfOldestMessage",
+		Type:  "Maximum",
+		Unit:  "Seconds",
+		Group: "queue",
+	},
+}
+
+// derivedMetricNames are the computed stats addDerivedMetrics adds on top of
+// the raw CloudWatch metrics above; all of them graph under "derived" (see
+// derivedGraph).
+var derivedMetricNames = []string{
+	"ProcessingRatePerMin",
+	"NetBacklogDelta",
+	"EmptyReceiveRatio",
+	"EstimatedDrainSeconds",
+}
+
+// metricGroup maps every stats key FetchMetrics can emit to the graph-key
+// segment it belongs to, so fetchAllQueues can embed that segment in its
+// multi-queue stats keys. mackerel-agent matches a wildcard graph key like
+// "#.messages" against the stats key itself, so in multi-queue mode the key
+// has to carry "messages"/"message_size"/"queue"/"derived" alongside the
+// queue name and metric name -- "<queue>.<metric>" alone doesn't match.
+var metricGroup = func() map[string]string {
+	groups := make(map[string]string, len(sqsMetrics)+len(derivedMetricNames))
+	for _, m := range sqsMetrics {
+		groups[m.name()] = m.Group
+	}
+	for _, name := range derivedMetricNames {
+		groups[name] = "derived"
+	}
+	return groups
+}()
+
+// multiQueue reports whether the plugin discovers queues via ListMetrics
+// instead of probing the single queue named by -queue-name.
+func (sp SQSPlugin) multiQueue() bool {
+	return sp.AllQueues || sp.QueueNamePattern != ""
+}
+
+// GraphDefinition interface for mackerel plugin
+func (sp SQSPlugin) GraphDefinition() map[string](mp.Graphs) {
+	if sp.multiQueue() {
+		// "#" is a wildcard segment (mackerel-agent matches it against any
+		// value), so one graph definition here covers every queue discovered
+		// at fetch time under "<prefix>.<queue>.messages" etc.
+		return map[string]mp.Graphs{
+			"#.messages": mp.Graphs{
+				Label: "SQS Message",
+				Unit:  "integer",
+				Metrics: [](mp.Metrics){
+					mp.Metrics{Name: "NumberOfMessagesSent", Label: "NumberOfMessagesSent"},
+					mp.Metrics{Name: "NumberOfMessagesReceived", Label: "NumberOfMessagesReceived"},
+					mp.Metrics{Name: "NumberOfMessagesDeleted", Label: "NumberOfMessagesDeleted"},
+					mp.Metrics{Name: "NumberOfEmptyReceives", Label: "NumberOfEmptyReceives"},
+				},
+			},
+			"#.message_size": mp.Graphs{
+				Label: "SQS Sent Message Size",
+				Unit:  "bytes",
+				Metrics: [](mp.Metrics){
+					mp.Metrics{Name: "SentMessageSizeAverage", Label: "SentMessageSizeAvg"},
+					mp.Metrics{Name: "SentMessageSizeMax", Label: "SentMessageSizeMax"},
+					mp.Metrics{Name: "SentMessageSizeMin", Label: "SentMessageSizeMin"},
+				},
+			},
+			"#.queue": mp.Graphs{
+				Label: "SQS Approximate Message",
+				Unit:  "integer",
+				Metrics: [](mp.Metrics){
+					mp.Metrics{Name: "ApproximateNumberOfMessagesDelayed", Label: "ApproximateNumberOfMessagesDelayed"},
+					mp.Metrics{Name: "ApproximateNumberOfMessagesVisible", Label: "ApproximateNumberOfMessagesVisible"},
+					mp.Metrics{Name: "ApproximateNumberOfMessagesNotVisible", Label: "ApproximateNumberOfMessagesNotVisible"},
+					mp.Metrics{Name: "ApproximateAgeOfOldestMessage", Label: "ApproximateAgeOfOldestMessage"},
+				},
+			},
+			"#.derived": derivedGraph("SQS"),
+		}
+	}
+
+	return map[string]mp.Graphs{
+		"messages": mp.Graphs{
+			Label: sp.QueueName + " Message",
+			Unit:  "integer",
+			Metrics: [](mp.Metrics){
+				mp.Metrics{Name: "NumberOfMessagesSent", Label: "NumberOfMessagesSent"},
+				mp.Metrics{Name: "NumberOfMessagesReceived", Label: "NumberOfMessagesReceived"},
+				mp.Metrics{Name: "NumberOfMessagesDeleted", Label: "NumberOfMessagesDeleted"},
+				mp.Metrics{Name: "NumberOfEmptyReceives", Label: "NumberOfEmptyReceives"},
+			},
+		},
+		"message_size": mp.Graphs{
+			Label: sp.QueueName + " Sent Message Size",
+			Unit:  "bytes",
+			Metrics: [](mp.Metrics){
+				mp.Metrics{Name: "SentMessageSizeAverage", Label: "SentMessageSizeAvg"},
+				mp.Metrics{Name: "SentMessageSizeMax", Label: "SentMessageSizeMax"},
+				mp.Metrics{Name: "SentMessageSizeMin", Label: "SentMessageSizeMin"},
+			},
+		},
+		"queue": mp.Graphs{
+			Label: sp.QueueName + " Approximate Message",
+			Unit:  "integer",
+			Metrics: [](mp.Metrics){
+				mp.Metrics{Name: "ApproximateNumberOfMessagesDelayed", Label: "ApproximateNumberOfMessagesDelayed"},
+				mp.Metrics{Name: "ApproximateNumberOfMessagesVisible", Label: "ApproximateNumberOfMessagesVisible"},
+				mp.Metrics{Name: "ApproximateNumberOfMessagesNotVisible", Label: "ApproximateNumberOfMessagesNotVisible"},
+				mp.Metrics{Name: "ApproximateAgeOfOldestMessage", Label: "ApproximateAgeOfOldestMessage"},
+			},
+		},
+		"derived": derivedGraph(sp.QueueName),
+	}
+}
+
+// derivedGraph is the graph definition for the computed, non-CloudWatch
+// metrics added by addDerivedMetrics.
+func derivedGraph(label string) mp.Graphs {
+	return mp.Graphs{
+		Label: label + " Derived",
+		Unit:  "float",
+		Metrics: [](mp.Metrics){
+			mp.Metrics{Name: "ProcessingRatePerMin", Label: "ProcessingRatePerMin"},
+			mp.Metrics{Name: "NetBacklogDelta", Label: "NetBacklogDelta"},
+			mp.Metrics{Name: "EmptyReceiveRatio", Label: "EmptyReceiveRatio"},
+			mp.Metrics{Name: "EstimatedDrainSeconds", Label: "EstimatedDrainSeconds"},
+		},
+	}
+}
+
+// MetricKeyPrefix interface for mackerel plugin
+func (sp SQSPlugin) MetricKeyPrefix() string {
+	if sp.Prefix != "" {
+		return sp.Prefix
+	}
+	if sp.multiQueue() {
+		return "sqs"
+	}
+	return "sqs." + sp.QueueName
+}
+
+// discoverQueues lists every AWS/SQS queue dimension value via
+// cloudwatch.ListMetrics, optionally filtered by -queue-name-pattern, and
+// caches the result for defaultQueueCacheTTL.
+func (sp *SQSPlugin) discoverQueues() ([]string, error) {
+	if sp.queueCache.valid() {
+		return sp.queueCache.queues, nil
+	}
+
+	var pattern *regexp.Regexp
+	if sp.QueueNamePattern != "" {
+		re, err := regexp.Compile(sp.QueueNamePattern)
+		if err != nil {
+			return nil, err
+		}
+		pattern = re
+	}
+
+	seen := make(map[string]bool)
+	var queues []string
+
+	input := &cloudwatch.ListMetricsInput{Namespace: aws.String("AWS/SQS")}
+	for {
+		output, err := sp.CloudWatch.ListMetrics(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range output.Metrics {
+			for _, d := range m.Dimensions {
+				if aws.StringValue(d.Name) != "QueueName" {
+					continue
+				}
+				name := aws.StringValue(d.Value)
+				if seen[name] || (pattern != nil && !pattern.MatchString(name)) {
+					continue
+				}
+				seen[name] = true
+				queues = append(queues, name)
+			}
+		}
+
+		if output.NextToken == nil {
+			break
+		}
+		input.NextToken = output.NextToken
+	}
+
+	sort.Strings(queues)
+	sp.queueCache = &queueCache{queues: queues, built: time.Now(), ttl: defaultQueueCacheTTL}
+
+	return queues, nil
+}
+
+// metricDataQueries builds one MetricDataQuery per metric for the given
+// queue, each carrying a unique Id so the GetMetricData response can be
+// matched back to its metric.
+func (sp SQSPlugin) metricDataQueries(queueName string) ([]*cloudwatch.MetricDataQuery, map[string]metric) {
+	queries := make([]*cloudwatch.MetricDataQuery, 0, len(sqsMetrics))
+	byID := make(map[string]metric, len(sqsMetrics))
+
+	for i, m := range sqsMetrics {
+		id := fmt.Sprintf("m%d", i)
+		byID[id] = m
+		queries = append(queries, &cloudwatch.MetricDataQuery{
+			Id: aws.String(id),
+			MetricStat: &cloudwatch.MetricStat{
+				Metric: &cloudwatch.Metric{
+					Namespace:  aws.String("AWS/SQS"),
+					MetricName: aws.String(m.Name),
+					Dimensions: []*cloudwatch.Dimension{
+						{
+							Name:  aws.String("QueueName"),
+							Value: aws.String(queueName),
+						},
+					},
+				},
+				Period: aws.Int64(sp.Period),
+				Stat:   aws.String(m.Type),
+				Unit:   aws.String(m.Unit),
+			},
+			ReturnData: aws.Bool(true),
+		})
+	}
+
+	return queries, byID
+}
+
+// FetchMetrics interface for mackerel plugin
+func (sp *SQSPlugin) FetchMetrics() (map[string]interface{}, error) {
+	if sp.multiQueue() {
+		return sp.fetchAllQueues()
+	}
+	return sp.fetchQueue(sp.QueueName)
+}
+
+// fetchQueue batches every configured metric for a single queue into one
+// GetMetricData call and returns them keyed flatly by metric name.
+func (sp SQSPlugin) fetchQueue(queueName string) (map[string]interface{}, error) {
+	queries, byID := sp.metricDataQueries(queueName)
+
+	delay := time.Duration(sp.Delay) * time.Second
+	period := time.Duration(sp.Period) * time.Second
+	endTime := time.Now().Add(-delay)
+	startTime := endTime.Add(-2 * period)
+
+	response, err := sp.CloudWatch.GetMetricData(&cloudwatch.GetMetricDataInput{
+		StartTime:         aws.Time(startTime),
+		EndTime:           aws.Time(endTime),
+		MetricDataQueries: queries,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]interface{})
+	for _, result := range response.MetricDataResults {
+		m, ok := byID[aws.StringValue(result.Id)]
+		if !ok {
+			continue
+		}
+
+		val, err := latestValue(result)
+		if err != nil {
+			log.Printf("%s %s: %s", queueName, m.name(), err)
+			continue
+		}
+		stats[m.name()] = val
+	}
+
+	addDerivedMetrics(stats, sp.Period)
+
+	return stats, nil
+}
+
+// derivedRateEpsilon keeps EstimatedDrainSeconds finite when a queue has
+// nothing draining it, rather than dividing by zero.
+const derivedRateEpsilon = 1e-9
+
+// addDerivedMetrics fills in the operator-facing signals operators actually
+// alert on -- is the consumer keeping up, and how long until the backlog
+// drains -- from the raw CloudWatch metrics already fetched for a queue.
+// periodSeconds is the -period the Sum metrics (NumberOfMessagesDeleted etc.)
+// were fetched over, since NumberOfMessagesDeleted is a total over that
+// window, not already a per-minute rate.
+func addDerivedMetrics(stats map[string]interface{}, periodSeconds int64) {
+	sent := floatStat(stats, "NumberOfMessagesSent")
+	deleted := floatStat(stats, "NumberOfMessagesDeleted")
+	received := floatStat(stats, "NumberOfMessagesReceived")
+	emptyReceives := floatStat(stats, "NumberOfEmptyReceives")
+	visible := floatStat(stats, "ApproximateNumberOfMessagesVisible")
+
+	periodMinutes := float64(periodSeconds) / 60
+	processingRatePerMin := deleted / periodMinutes
+	stats["ProcessingRatePerMin"] = processingRatePerMin
+	stats["NetBacklogDelta"] = sent - deleted
+
+	receiveAttempts := received + emptyReceives
+	if receiveAttempts < 1 {
+		receiveAttempts = 1
+	}
+	stats["EmptyReceiveRatio"] = emptyReceives / receiveAttempts
+
+	processingRatePerSec := processingRatePerMin / 60
+	if processingRatePerSec < derivedRateEpsilon {
+		processingRatePerSec = derivedRateEpsilon
+	}
+	stats["EstimatedDrainSeconds"] = visible / processingRatePerSec
+}
+
+// floatStat reads a raw metric out of a stats map, defaulting to 0 when the
+// metric failed to fetch (and so is absent from the map).
+func floatStat(stats map[string]interface{}, name string) float64 {
+	v, _ := stats[name].(float64)
+	return v
+}
+
+// fetchAllQueues discovers every matching queue and fans the batched
+// GetMetricData fetch out across them, pacing requests at -rate-limit
+// reqs/sec to avoid tripping CloudWatch throttling.
+func (sp *SQSPlugin) fetchAllQueues() (map[string]interface{}, error) {
+	queues, err := sp.discoverQueues()
+	if err != nil {
+		return nil, err
+	}
+
+	var interval time.Duration
+	if sp.RateLimit > 0 {
+		interval = time.Duration(float64(time.Second) / sp.RateLimit)
+	}
+
+	stats := make(map[string]interface{})
+	for i, queueName := range queues {
+		if i > 0 && interval > 0 {
+			time.Sleep(interval)
+		}
+
+		queueStats, err := sp.fetchQueue(queueName)
+		if err != nil {
+			log.Printf("%s: %s", queueName, err)
+			continue
+		}
+		for name, val := range queueStats {
+			stats[queueName+"."+metricGroup[name]+"."+name] = val
+		}
+	}
+
+	return stats, nil
+}
+
+// latestValue picks the value for the most recent timestamp in a
+// GetMetricData result. Datapoints aren't guaranteed to arrive in order, so
+// this can't just take the first or last element.
+func latestValue(result *cloudwatch.MetricDataResult) (float64, error) {
+	if len(result.Timestamps) == 0 {
+		return 0, errors.New("fetched no datapoints")
+	}
+
+	var latest time.Time
+	var latestVal float64
+	for i, ts := range result.Timestamps {
+		if ts.After(latest) {
+			latest = *ts
+			latestVal = *result.Values[i]
+		}
+	}
+
+	return latestVal, nil
+}
+
+// Prepare builds the CloudWatch client, following the same credential
+// precedence as telegraf's cloudwatch input: explicit static keys, then STS
+// AssumeRole (layered on top of whatever base credentials were resolved),
+// then the SDK's default chain of env vars, shared credentials file/profile,
+// and EC2/ECS instance profile.
+func (sp *SQSPlugin) Prepare() error {
+	config := aws.NewConfig().WithRegion(sp.Region)
+	if sp.EndpointURL != "" {
+		config = config.WithEndpoint(sp.EndpointURL)
+	}
+
+	switch {
+	case sp.AccessKeyID != "" && sp.SecretAccessKey != "":
+		config = config.WithCredentials(credentials.NewStaticCredentials(sp.AccessKeyID, sp.SecretAccessKey, sp.Token))
+	case sp.Profile != "" || sp.SharedCredentialFile != "":
+		config = config.WithCredentials(credentials.NewSharedCredentials(sp.SharedCredentialFile, sp.Profile))
+	}
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return err
+	}
+
+	if sp.RoleARN != "" {
+		config = config.WithCredentials(stscreds.NewCredentials(sess, sp.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			if sp.ExternalID != "" {
+				p.ExternalID = aws.String(sp.ExternalID)
+			}
+			if sp.RoleSessionName != "" {
+				p.RoleSessionName = sp.RoleSessionName
+			}
+		}))
+	}
+
+	sp.CloudWatch = cloudwatch.New(sess, config)
+
+	return nil
+}
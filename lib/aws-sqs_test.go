@@ -0,0 +1,282 @@
+package lib
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// fakeCloudWatch implements cloudwatchClient with canned responses, so
+// FetchMetrics/discoverQueues can be exercised without a real AWS account.
+type fakeCloudWatch struct {
+	getMetricDataOutput *cloudwatch.GetMetricDataOutput
+	getMetricDataErr    error
+	listMetricsOutput   *cloudwatch.ListMetricsOutput
+	listMetricsErr      error
+}
+
+func (f *fakeCloudWatch) GetMetricStatistics(*cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	return nil, errors.New("GetMetricStatistics not used by this plugin")
+}
+
+func (f *fakeCloudWatch) GetMetricData(*cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+	return f.getMetricDataOutput, f.getMetricDataErr
+}
+
+func (f *fakeCloudWatch) ListMetrics(*cloudwatch.ListMetricsInput) (*cloudwatch.ListMetricsOutput, error) {
+	return f.listMetricsOutput, f.listMetricsErr
+}
+
+func dataResult(id string, timestamps []time.Time, values []float64) *cloudwatch.MetricDataResult {
+	tsPtrs := make([]*time.Time, len(timestamps))
+	for i := range timestamps {
+		tsPtrs[i] = &timestamps[i]
+	}
+	valPtrs := make([]*float64, len(values))
+	for i := range values {
+		valPtrs[i] = &values[i]
+	}
+	return &cloudwatch.MetricDataResult{
+		Id:         aws.String(id),
+		Timestamps: tsPtrs,
+		Values:     valPtrs,
+	}
+}
+
+func TestLatestValuePicksMostRecentTimestamp(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		name   string
+		result *cloudwatch.MetricDataResult
+		want   float64
+	}{
+		{
+			name:   "ascending order",
+			result: dataResult("m0", []time.Time{now.Add(-2 * time.Minute), now.Add(-1 * time.Minute), now}, []float64{1, 2, 3}),
+			want:   3,
+		},
+		{
+			name:   "descending order",
+			result: dataResult("m0", []time.Time{now, now.Add(-1 * time.Minute), now.Add(-2 * time.Minute)}, []float64{3, 2, 1}),
+			want:   3,
+		},
+		{
+			name:   "out of order",
+			result: dataResult("m0", []time.Time{now.Add(-1 * time.Minute), now, now.Add(-2 * time.Minute)}, []float64{2, 3, 1}),
+			want:   3,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := latestValue(c.result)
+			if err != nil {
+				t.Fatalf("latestValue() error = %v", err)
+			}
+			if got != c.want {
+				t.Errorf("latestValue() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestLatestValueNoDatapoints(t *testing.T) {
+	_, err := latestValue(dataResult("m0", nil, nil))
+	if err == nil {
+		t.Fatal("latestValue() error = nil, want an error for an empty result")
+	}
+}
+
+func TestMetricDataQueriesStatAndUnit(t *testing.T) {
+	sp := SQSPlugin{Period: 60}
+	queries, byID := sp.metricDataQueries("my-queue")
+
+	if len(queries) != len(sqsMetrics) {
+		t.Fatalf("got %d queries, want %d", len(queries), len(sqsMetrics))
+	}
+
+	for _, q := range queries {
+		m, ok := byID[aws.StringValue(q.Id)]
+		if !ok {
+			t.Fatalf("query Id %q not found in byID map", aws.StringValue(q.Id))
+		}
+		if got := aws.StringValue(q.MetricStat.Stat); got != m.Type {
+			t.Errorf("%s: Stat = %q, want %q", m.name(), got, m.Type)
+		}
+		if got := aws.StringValue(q.MetricStat.Unit); got != m.Unit {
+			t.Errorf("%s: Unit = %q, want %q", m.name(), got, m.Unit)
+		}
+		if got := aws.StringValue(q.MetricStat.Metric.MetricName); got != m.Name {
+			t.Errorf("%s: MetricName = %q, want %q", m.name(), got, m.Name)
+		}
+	}
+}
+
+func TestFetchQueuePopulatesEveryMetric(t *testing.T) {
+	sp := SQSPlugin{QueueName: "my-queue", Period: 60, Delay: 300}
+	_, byID := sp.metricDataQueries(sp.QueueName)
+
+	now := time.Now()
+	results := make([]*cloudwatch.MetricDataResult, 0, len(byID))
+	for id := range byID {
+		results = append(results, dataResult(id, []time.Time{now}, []float64{42}))
+	}
+
+	sp.CloudWatch = &fakeCloudWatch{
+		getMetricDataOutput: &cloudwatch.GetMetricDataOutput{MetricDataResults: results},
+	}
+
+	stats, err := sp.fetchQueue(sp.QueueName)
+	if err != nil {
+		t.Fatalf("fetchQueue() error = %v", err)
+	}
+
+	for _, m := range sqsMetrics {
+		if _, ok := stats[m.name()]; !ok {
+			t.Errorf("stats missing %q", m.name())
+		}
+	}
+}
+
+func TestGraphDefinitionIncludesEveryFetchedKey(t *testing.T) {
+	sp := &SQSPlugin{QueueName: "my-queue", Period: 60, Delay: 300}
+	_, byID := sp.metricDataQueries(sp.QueueName)
+
+	now := time.Now()
+	results := make([]*cloudwatch.MetricDataResult, 0, len(byID))
+	for id := range byID {
+		results = append(results, dataResult(id, []time.Time{now}, []float64{1}))
+	}
+	sp.CloudWatch = &fakeCloudWatch{
+		getMetricDataOutput: &cloudwatch.GetMetricDataOutput{MetricDataResults: results},
+	}
+
+	stats, err := sp.FetchMetrics()
+	if err != nil {
+		t.Fatalf("FetchMetrics() error = %v", err)
+	}
+
+	graphed := make(map[string]bool)
+	for _, graph := range sp.GraphDefinition() {
+		for _, m := range graph.Metrics {
+			graphed[m.Name] = true
+		}
+	}
+
+	for key := range stats {
+		if !graphed[key] {
+			t.Errorf("stats key %q has no graph definition entry", key)
+		}
+	}
+}
+
+func TestAddDerivedMetrics(t *testing.T) {
+	stats := map[string]interface{}{
+		"NumberOfMessagesSent":               100.0,
+		"NumberOfMessagesDeleted":            80.0,
+		"NumberOfMessagesReceived":           90.0,
+		"NumberOfEmptyReceives":              10.0,
+		"ApproximateNumberOfMessagesVisible": 400.0,
+	}
+
+	addDerivedMetrics(stats, 60)
+
+	if got, want := stats["ProcessingRatePerMin"], 80.0; got != want {
+		t.Errorf("ProcessingRatePerMin = %v, want %v", got, want)
+	}
+	if got, want := stats["NetBacklogDelta"], 20.0; got != want {
+		t.Errorf("NetBacklogDelta = %v, want %v", got, want)
+	}
+	if got, want := stats["EmptyReceiveRatio"], 0.1; got != want {
+		t.Errorf("EmptyReceiveRatio = %v, want %v", got, want)
+	}
+	if got, want := stats["EstimatedDrainSeconds"], 300.0; got != want {
+		t.Errorf("EstimatedDrainSeconds = %v, want %v", got, want)
+	}
+}
+
+func TestAddDerivedMetricsNoThroughput(t *testing.T) {
+	stats := map[string]interface{}{
+		"ApproximateNumberOfMessagesVisible": 50.0,
+	}
+
+	addDerivedMetrics(stats, 60)
+
+	if got := stats["EstimatedDrainSeconds"].(float64); got <= 0 {
+		t.Errorf("EstimatedDrainSeconds = %v, want a large positive number when nothing is draining the queue", got)
+	}
+	if got, want := stats["EmptyReceiveRatio"], 0.0; got != want {
+		t.Errorf("EmptyReceiveRatio = %v, want %v", got, want)
+	}
+}
+
+// TestAddDerivedMetricsNormalizesToPeriod pins a regression where
+// ProcessingRatePerMin/EstimatedDrainSeconds used the raw Sum over -period
+// seconds unnormalized, so anything other than the default -period 60
+// silently reported the wrong rate.
+func TestAddDerivedMetricsNormalizesToPeriod(t *testing.T) {
+	stats := map[string]interface{}{
+		"NumberOfMessagesDeleted":            80.0,
+		"ApproximateNumberOfMessagesVisible": 400.0,
+	}
+
+	addDerivedMetrics(stats, 300)
+
+	if got, want := stats["ProcessingRatePerMin"], 16.0; got != want {
+		t.Errorf("ProcessingRatePerMin = %v, want %v (80 deleted over a 300s period is 16/min)", got, want)
+	}
+	if got, want := stats["EstimatedDrainSeconds"], 1500.0; got != want {
+		t.Errorf("EstimatedDrainSeconds = %v, want %v", got, want)
+	}
+}
+
+// TestFetchAllQueuesStatsKeysMatchWildcardGraphs guards against a regression
+// where fetchAllQueues emitted keys like "<queue>.<metric>", which never
+// matches a "#.messages"-style wildcard graph key: mackerel-agent builds its
+// match regex from the graph key plus metric name and applies it to the
+// stats key itself, so the key must carry the graph-key segment too.
+func TestFetchAllQueuesStatsKeysMatchWildcardGraphs(t *testing.T) {
+	sp := &SQSPlugin{AllQueues: true, Period: 60, Delay: 300}
+
+	sp.CloudWatch = &fakeCloudWatch{
+		listMetricsOutput: &cloudwatch.ListMetricsOutput{
+			Metrics: []*cloudwatch.Metric{
+				{Dimensions: []*cloudwatch.Dimension{{Name: aws.String("QueueName"), Value: aws.String("queue-alpha")}}},
+			},
+		},
+	}
+	_, byID := sp.metricDataQueries("queue-alpha")
+	now := time.Now()
+	results := make([]*cloudwatch.MetricDataResult, 0, len(byID))
+	for id := range byID {
+		results = append(results, dataResult(id, []time.Time{now}, []float64{1}))
+	}
+	sp.CloudWatch.(*fakeCloudWatch).getMetricDataOutput = &cloudwatch.GetMetricDataOutput{MetricDataResults: results}
+
+	stats, err := sp.FetchMetrics()
+	if err != nil {
+		t.Fatalf("FetchMetrics() error = %v", err)
+	}
+
+	segments := make(map[string]bool)
+	for graphKey, graph := range sp.GraphDefinition() {
+		group := strings.TrimPrefix(graphKey, "#.")
+		for _, m := range graph.Metrics {
+			segments["queue-alpha."+group+"."+m.Name] = true
+		}
+	}
+
+	if len(stats) != len(segments) {
+		t.Fatalf("got %d stats keys, want %d", len(stats), len(segments))
+	}
+	for key := range stats {
+		if !segments[key] {
+			t.Errorf("stats key %q doesn't match any wildcard graph key + metric name", key)
+		}
+	}
+}
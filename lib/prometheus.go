@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// PrometheusExporter serves the same metrics FetchMetrics collects for
+// Mackerel as Prometheus gauges, so one binary can back both a Mackerel
+// agent scrape and a Prometheus federation target against the same
+// CloudWatch quota, instead of running two separate exporters.
+type PrometheusExporter struct {
+	Plugin         *SQSPlugin
+	ScrapeInterval time.Duration
+
+	mu     sync.RWMutex
+	gauges map[string]*prometheus.GaugeVec
+}
+
+// NewPrometheusExporter builds an exporter that refreshes sp's metrics every
+// scrapeInterval.
+func NewPrometheusExporter(sp *SQSPlugin, scrapeInterval time.Duration) *PrometheusExporter {
+	return &PrometheusExporter{
+		Plugin:         sp,
+		ScrapeInterval: scrapeInterval,
+		gauges:         make(map[string]*prometheus.GaugeVec),
+	}
+}
+
+// Serve refreshes metrics once synchronously, starts a background goroutine
+// to keep refreshing them every ScrapeInterval, and then blocks serving
+// Prometheus text format at /metrics on addr.
+func (e *PrometheusExporter) Serve(addr string) error {
+	if e.ScrapeInterval <= 0 {
+		return fmt.Errorf("scrape interval must be positive, got %s", e.ScrapeInterval)
+	}
+
+	e.refresh()
+
+	go func() {
+		ticker := time.NewTicker(e.ScrapeInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			e.refresh()
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+	return server.ListenAndServe()
+}
+
+func (e *PrometheusExporter) refresh() {
+	stats, err := e.Plugin.FetchMetrics()
+	if err != nil {
+		log.Printf("prometheus exporter: %s", err)
+		return
+	}
+
+	// Reset before repopulating so a queue that's gone (deleted, or no
+	// longer matched by -queue-name-pattern/-all-queues) drops out of
+	// /metrics instead of reporting its last-known value forever.
+	e.mu.RLock()
+	for _, g := range e.gauges {
+		g.Reset()
+	}
+	e.mu.RUnlock()
+
+	for key, val := range stats {
+		v, ok := val.(float64)
+		if !ok {
+			continue
+		}
+
+		queueName, metricName := e.splitKey(key)
+		e.gaugeFor(metricName).WithLabelValues(queueName, e.Plugin.Region).Set(v)
+	}
+}
+
+// splitKey recovers the queue name and raw metric name from a FetchMetrics
+// key. In multi-queue mode keys are "<queue>.<group>.<metric>" (see
+// fetchAllQueues/metricGroup); in single-queue mode the key is just the
+// metric name and the queue comes from -queue-name.
+func (e *PrometheusExporter) splitKey(key string) (queueName, metricName string) {
+	if e.Plugin.multiQueue() {
+		if i, j := strings.Index(key, "."), strings.LastIndex(key, "."); i >= 0 && j > i {
+			return key[:i], key[j+1:]
+		}
+	}
+	return e.Plugin.QueueName, key
+}
+
+func (e *PrometheusExporter) gaugeFor(metricName string) *prometheus.GaugeVec {
+	e.mu.RLock()
+	g, ok := e.gauges[metricName]
+	e.mu.RUnlock()
+	if ok {
+		return g
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if g, ok := e.gauges[metricName]; ok {
+		return g
+	}
+
+	g = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sqs",
+		Name:      prometheusMetricName(metricName),
+		Help:      fmt.Sprintf("SQS %s, as reported by CloudWatch or computed from CloudWatch metrics.", metricName),
+	}, []string{"queue_name", "region"})
+	prometheus.MustRegister(g)
+	e.gauges[metricName] = g
+
+	return g
+}
+
+var prometheusNameBoundary = regexp.MustCompile("([a-z0-9])([A-Z])")
+
+// prometheusMetricName converts a CamelCase CloudWatch/derived metric name
+// (e.g. "NumberOfMessagesSent") into the snake_case Prometheus convention
+// ("number_of_messages_sent").
+func prometheusMetricName(name string) string {
+	return strings.ToLower(prometheusNameBoundary.ReplaceAllString(name, "${1}_${2}"))
+}
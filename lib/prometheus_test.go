@@ -0,0 +1,65 @@
+package lib
+
+import "testing"
+
+func TestSplitKey(t *testing.T) {
+	cases := []struct {
+		name       string
+		plugin     *SQSPlugin
+		key        string
+		wantQueue  string
+		wantMetric string
+	}{
+		{
+			name:       "single-queue mode returns the configured queue name",
+			plugin:     &SQSPlugin{QueueName: "my-queue"},
+			key:        "NumberOfMessagesSent",
+			wantQueue:  "my-queue",
+			wantMetric: "NumberOfMessagesSent",
+		},
+		{
+			name:       "multi-queue mode splits queue, group, and metric",
+			plugin:     &SQSPlugin{AllQueues: true},
+			key:        "queue-alpha.messages.NumberOfMessagesSent",
+			wantQueue:  "queue-alpha",
+			wantMetric: "NumberOfMessagesSent",
+		},
+		{
+			name:       "multi-queue mode with a queue-name-pattern",
+			plugin:     &SQSPlugin{QueueNamePattern: "^prod-"},
+			key:        "prod-orders.derived.EstimatedDrainSeconds",
+			wantQueue:  "prod-orders",
+			wantMetric: "EstimatedDrainSeconds",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := &PrometheusExporter{Plugin: c.plugin}
+			gotQueue, gotMetric := e.splitKey(c.key)
+			if gotQueue != c.wantQueue || gotMetric != c.wantMetric {
+				t.Errorf("splitKey(%q) = (%q, %q), want (%q, %q)", c.key, gotQueue, gotMetric, c.wantQueue, c.wantMetric)
+			}
+		})
+	}
+}
+
+func TestPrometheusMetricName(t *testing.T) {
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"NumberOfMessagesSent", "number_of_messages_sent"},
+		{"SentMessageSizeAverage", "sent_message_size_average"},
+		{"ApproximateAgeOfOldestMessage", "approximate_age_of_oldest_message"},
+		{"EstimatedDrainSeconds", "estimated_drain_seconds"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := prometheusMetricName(c.name); got != c.want {
+				t.Errorf("prometheusMetricName(%q) = %q, want %q", c.name, got, c.want)
+			}
+		})
+	}
+}